@@ -0,0 +1,28 @@
+package turnpike
+
+import (
+	"github.com/ugorji/go/codec"
+)
+
+// CBORSerializer is a Serializer that handles CBOR encoded bytes.
+type CBORSerializer struct{}
+
+// Serialize implements the Serializer interface.
+func (s *CBORSerializer) Serialize(msg Message) ([]byte, error) {
+	var b []byte
+	enc := codec.NewEncoderBytes(&b, new(codec.CborHandle))
+	if err := enc.Encode(toList(msg)); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// Deserialize implements the Serializer interface.
+func (s *CBORSerializer) Deserialize(data []byte) (Message, error) {
+	var v []interface{}
+	dec := codec.NewDecoderBytes(data, new(codec.CborHandle))
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	return fromList(v)
+}
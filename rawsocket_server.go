@@ -0,0 +1,347 @@
+package turnpike
+
+import (
+	"fmt"
+	"net"
+	"sync"
+)
+
+const (
+	rawSocketMagic = 0x7F
+
+	rawSocketMsgTypeRegular = 0
+	rawSocketMsgTypePing    = 1
+	rawSocketMsgTypePong    = 2
+
+	rawSocketMaxLengthDefault = 15 // 2^(9+15) == 16MB
+
+	rawSocketErrorIllegalMessage        = 0
+	rawSocketErrorSerializerUnsupported = 1
+	rawSocketErrorMaxLengthUnacceptable = 2
+	rawSocketErrorUseOfReservedBits     = 3
+	rawSocketErrorMaxConnectionCount    = 4
+)
+
+const (
+	jsonRawSocketSerializer    = 1
+	msgpackRawSocketSerializer = 2
+)
+
+type rawSocketHandshakeError byte
+
+func (e rawSocketHandshakeError) Error() string {
+	return fmt.Sprintf("RawSocket handshake rejected with error code: %d", e)
+}
+
+type serializerExists byte
+
+func (e serializerExists) Error() string {
+	return fmt.Sprintf("This serializer id has already been registered: %d", byte(e))
+}
+
+type invalidMaxLength byte
+
+func (e invalidMaxLength) Error() string {
+	return fmt.Sprintf("Invalid max message length exponent: %d (must be 0-15)", byte(e))
+}
+
+// RawSocketServer handles WAMP RawSocket connections over TCP or Unix domain
+// sockets.
+type RawSocketServer struct {
+	Router
+
+	serializers map[byte]Serializer
+
+	// MaxLength is the base-2 exponent advertised during the handshake,
+	// describing the largest message this server is willing to receive.
+	// Defaults to rawSocketMaxLengthDefault.
+	MaxLength byte
+}
+
+type RawSocketServerOption func(server *RawSocketServer)
+
+// MaxMessageLength sets the maximum message length exponent advertised
+// during the RawSocket handshake. Per the WAMP RawSocket spec this is a
+// 4-bit field, so exponent must be 0-15; values outside that range are
+// clamped to 15 (16MB) and logged rather than silently corrupting the
+// handshake ack.
+func MaxMessageLength(exponent byte) RawSocketServerOption {
+	return func(server *RawSocketServer) {
+		if exponent > 15 {
+			log.Println("Invalid MaxMessageLength exponent, clamping to 15:", invalidMaxLength(exponent))
+			exponent = 15
+		}
+		server.MaxLength = exponent
+	}
+}
+
+// NewRawSocketServer creates a new RawSocketServer from a map of realms.
+func NewRawSocketServer(realms map[string]Realm, options ...RawSocketServerOption) (*RawSocketServer, error) {
+	log.Println("NewRawSocketServer")
+	r := NewDefaultRouter()
+	for uri, realm := range realms {
+		if err := r.RegisterRealm(URI(uri), realm); err != nil {
+			return nil, err
+		}
+	}
+	s := newRawSocketServer(r, options...)
+	return s, nil
+}
+
+// NewBasicRawSocketServer creates a new RawSocketServer with a single basic realm.
+func NewBasicRawSocketServer(uri string, options ...RawSocketServerOption) *RawSocketServer {
+	log.Println("NewBasicRawSocketServer")
+	s, _ := NewRawSocketServer(map[string]Realm{uri: {}}, options...)
+	return s
+}
+
+func newRawSocketServer(r Router, options ...RawSocketServerOption) *RawSocketServer {
+	s := &RawSocketServer{
+		Router:      r,
+		serializers: make(map[byte]Serializer),
+		MaxLength:   rawSocketMaxLengthDefault,
+	}
+	s.RegisterSerializer(jsonRawSocketSerializer, new(JSONSerializer))
+	s.RegisterSerializer(msgpackRawSocketSerializer, new(MessagePackSerializer))
+	for _, o := range options {
+		o(s)
+	}
+	return s
+}
+
+// RegisterSerializer registers a serializer that should be used for a given
+// RawSocket serializer id, as sent in the low nibble of the handshake byte.
+func (s *RawSocketServer) RegisterSerializer(id byte, serializer Serializer) error {
+	log.Println("RegisterSerializer:", id)
+	if _, ok := s.serializers[id]; ok {
+		return serializerExists(id)
+	}
+	s.serializers[id] = serializer
+	return nil
+}
+
+// ListenAndServe listens on the given network and address (e.g. "tcp",
+// "localhost:8181" or "unix", "/tmp/turnpike.sock") and serves WAMP
+// RawSocket connections.
+func (s *RawSocketServer) ListenAndServe(network, addr string) error {
+	log.Println("RawSocketServer.ListenAndServe", network, addr)
+	l, err := net.Listen(network, addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+// Serve accepts connections on the given listener and serves WAMP RawSocket
+// connections until the listener is closed.
+func (s *RawSocketServer) Serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go s.handleRawSocket(conn)
+	}
+}
+
+func (s *RawSocketServer) handleRawSocket(conn net.Conn) {
+	result, err := s.handshake(conn)
+	if err != nil {
+		log.Println("Error completing RawSocket handshake:", err)
+		conn.Close()
+		return
+	}
+
+	peer := rawSocketPeer{
+		conn:          conn,
+		serializer:    result.serializer,
+		messages:      make(chan Message, 10),
+		maxRecvLength: result.ourMaxBytes,
+		maxSendLength: result.peerMaxBytes,
+		done:          make(chan struct{}),
+	}
+	go peer.readLoop()
+	s.Router.Accept(&peer)
+}
+
+// rawSocketHandshakeResult carries what was negotiated during the
+// handshake: the serializer to use, and the maximum frame length each side
+// agreed to receive.
+type rawSocketHandshakeResult struct {
+	serializer   Serializer
+	ourMaxBytes  int
+	peerMaxBytes int
+}
+
+// rawSocketMaxBytes converts a handshake max-length nibble (0-15) into the
+// maximum frame length in bytes it advertises, per the WAMP RawSocket spec:
+// 2^(9+exponent). Exponents outside that range are clamped to 15.
+func rawSocketMaxBytes(exponent byte) int {
+	if exponent > 15 {
+		exponent = 15
+	}
+	return 1 << (9 + uint(exponent))
+}
+
+// handshake performs the 4-byte RawSocket handshake described in the WAMP
+// spec: magic byte, (max-length nibble | serializer-id nibble), and two
+// reserved bytes that must currently be zero.
+func (s *RawSocketServer) handshake(conn net.Conn) (*rawSocketHandshakeResult, error) {
+	hello := make([]byte, 4)
+	if _, err := readFull(conn, hello); err != nil {
+		return nil, err
+	}
+	if hello[0] != rawSocketMagic {
+		s.sendHandshakeError(conn, rawSocketErrorIllegalMessage)
+		return nil, rawSocketHandshakeError(rawSocketErrorIllegalMessage)
+	}
+	if hello[2] != 0 || hello[3] != 0 {
+		s.sendHandshakeError(conn, rawSocketErrorUseOfReservedBits)
+		return nil, rawSocketHandshakeError(rawSocketErrorUseOfReservedBits)
+	}
+
+	// Both nibbles of hello[1] are 4 bits wide, so peerMaxLength is always
+	// in 0-15 and serializerID always in 0-15; neither can be out of range.
+	peerMaxLength := hello[1] >> 4
+	serializerID := hello[1] & 0x0F
+
+	serializer, ok := s.serializers[serializerID]
+	if !ok {
+		s.sendHandshakeError(conn, rawSocketErrorSerializerUnsupported)
+		return nil, rawSocketHandshakeError(rawSocketErrorSerializerUnsupported)
+	}
+
+	ack := []byte{rawSocketMagic, s.MaxLength<<4 | serializerID, 0, 0}
+	if _, err := conn.Write(ack); err != nil {
+		return nil, err
+	}
+	return &rawSocketHandshakeResult{
+		serializer:   serializer,
+		ourMaxBytes:  rawSocketMaxBytes(s.MaxLength),
+		peerMaxBytes: rawSocketMaxBytes(peerMaxLength),
+	}, nil
+}
+
+func (s *RawSocketServer) sendHandshakeError(conn net.Conn, code byte) {
+	conn.Write([]byte{rawSocketMagic, code << 4, 0, 0})
+}
+
+func readFull(conn net.Conn, buf []byte) (int, error) {
+	total := 0
+	for total < len(buf) {
+		n, err := conn.Read(buf[total:])
+		total += n
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+type rawSocketPeer struct {
+	conn       net.Conn
+	serializer Serializer
+	messages   chan Message
+
+	// maxRecvLength is the frame length, in bytes, we advertised being
+	// willing to accept during the handshake; maxSendLength is the frame
+	// length the peer advertised being willing to accept.
+	maxRecvLength int
+	maxSendLength int
+
+	// writeMu serializes writeFrame calls: both readLoop (replying to
+	// PINGs) and Send (dispatching outbound WAMP messages) write to conn.
+	writeMu sync.Mutex
+
+	// done is closed by Close so that readLoop can stop blocking on
+	// messages once the router has stopped draining it.
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func (p *rawSocketPeer) readLoop() {
+	header := make([]byte, 4)
+	for {
+		if _, err := readFull(p.conn, header); err != nil {
+			p.conn.Close()
+			return
+		}
+		msgType := header[0]
+		length := uint32(header[1])<<16 | uint32(header[2])<<8 | uint32(header[3])
+
+		if int(length) > p.maxRecvLength {
+			log.Println("RawSocket peer exceeded negotiated max length, closing connection")
+			p.conn.Close()
+			return
+		}
+
+		payload := make([]byte, length)
+		if _, err := readFull(p.conn, payload); err != nil {
+			p.conn.Close()
+			return
+		}
+
+		switch msgType {
+		case rawSocketMsgTypePing:
+			p.writeFrame(rawSocketMsgTypePong, payload)
+		case rawSocketMsgTypePong:
+			// no-op: we don't currently send pings to be answered
+		case rawSocketMsgTypeRegular:
+			msg, err := p.serializer.Deserialize(payload)
+			if err != nil {
+				// TODO: handle error
+			} else {
+				select {
+				case p.messages <- msg:
+				case <-p.done:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (p *rawSocketPeer) writeFrame(msgType byte, payload []byte) error {
+	if len(payload) > p.maxSendLength {
+		return fmt.Errorf("turnpike: frame of %d bytes exceeds peer's negotiated max length of %d", len(payload), p.maxSendLength)
+	}
+
+	p.writeMu.Lock()
+	defer p.writeMu.Unlock()
+
+	header := make([]byte, 4)
+	header[0] = msgType
+	length := len(payload)
+	header[1] = byte(length >> 16)
+	header[2] = byte(length >> 8)
+	header[3] = byte(length)
+	if _, err := p.conn.Write(header); err != nil {
+		return err
+	}
+	_, err := p.conn.Write(payload)
+	return err
+}
+
+// Send serializes and writes a message to the peer as a regular RawSocket frame.
+func (p *rawSocketPeer) Send(msg Message) error {
+	b, err := p.serializer.Serialize(msg)
+	if err != nil {
+		return err
+	}
+	return p.writeFrame(rawSocketMsgTypeRegular, b)
+}
+
+// Receive returns the channel of messages sent by the peer.
+func (p *rawSocketPeer) Receive() <-chan Message {
+	return p.messages
+}
+
+// Close signals readLoop to stop (unblocking any pending send on messages)
+// and closes the underlying connection. It is safe to call Close multiple
+// times.
+func (p *rawSocketPeer) Close() error {
+	p.closeOnce.Do(func() {
+		close(p.done)
+	})
+	return p.conn.Close()
+}
@@ -0,0 +1,152 @@
+package turnpike
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+type rawSocketTestSerializer struct{}
+
+func (rawSocketTestSerializer) Serialize(msg Message) ([]byte, error)  { return []byte("x"), nil }
+func (rawSocketTestSerializer) Deserialize(b []byte) (Message, error) { return nil, nil }
+
+func TestRawSocketMaxBytes(t *testing.T) {
+	cases := []struct {
+		exponent byte
+		want     int
+	}{
+		{0, 512},
+		{9, 262144},
+		{15, 16777216},
+		{20, 16777216}, // out-of-range exponents clamp to 15
+	}
+	for _, c := range cases {
+		if got := rawSocketMaxBytes(c.exponent); got != c.want {
+			t.Errorf("rawSocketMaxBytes(%d) = %d, want %d", c.exponent, got, c.want)
+		}
+	}
+}
+
+func TestRawSocketHandshakeAck(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+
+	s := newRawSocketServer(nil)
+
+	result := make(chan *rawSocketHandshakeResult, 1)
+	errs := make(chan error, 1)
+	go func() {
+		r, err := s.handshake(server)
+		result <- r
+		errs <- err
+	}()
+
+	// hello: magic, (maxLength=5 nibble | json serializer id), reserved bytes
+	if _, err := client.Write([]byte{rawSocketMagic, 5<<4 | jsonRawSocketSerializer, 0, 0}); err != nil {
+		t.Fatal(err)
+	}
+
+	ack := make([]byte, 4)
+	if _, err := readFull(client, ack); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errs; err != nil {
+		t.Fatalf("handshake returned error: %v", err)
+	}
+	r := <-result
+
+	if ack[0] != rawSocketMagic {
+		t.Errorf("ack[0] = %#x, want magic byte %#x", ack[0], rawSocketMagic)
+	}
+	if ack[1]&0x0F != jsonRawSocketSerializer {
+		t.Errorf("ack serializer id = %d, want %d", ack[1]&0x0F, jsonRawSocketSerializer)
+	}
+	if r.peerMaxBytes != rawSocketMaxBytes(5) {
+		t.Errorf("peerMaxBytes = %d, want %d", r.peerMaxBytes, rawSocketMaxBytes(5))
+	}
+}
+
+func TestRawSocketHandshakeRejectsUnsupportedSerializer(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+
+	s := newRawSocketServer(nil)
+
+	errs := make(chan error, 1)
+	go func() {
+		_, err := s.handshake(server)
+		errs <- err
+	}()
+
+	if _, err := client.Write([]byte{rawSocketMagic, 0<<4 | 0x0F, 0, 0}); err != nil {
+		t.Fatal(err)
+	}
+
+	ack := make([]byte, 4)
+	if _, err := readFull(client, ack); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errs; err == nil {
+		t.Fatal("expected handshake to reject an unregistered serializer id")
+	}
+	if ack[1]>>4 != rawSocketErrorSerializerUnsupported {
+		t.Errorf("error code = %d, want %d", ack[1]>>4, rawSocketErrorSerializerUnsupported)
+	}
+}
+
+func TestRawSocketWriteFrameRejectsOversizedPayload(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+
+	p := &rawSocketPeer{conn: server, maxSendLength: 4}
+	if err := p.writeFrame(rawSocketMsgTypeRegular, []byte("too long")); err == nil {
+		t.Fatal("expected writeFrame to reject a payload larger than the peer's negotiated max length")
+	}
+}
+
+func TestRawSocketReadLoopUnblocksOnClose(t *testing.T) {
+	server, client := net.Pipe()
+	defer client.Close()
+
+	p := &rawSocketPeer{
+		conn:          server,
+		serializer:    rawSocketTestSerializer{},
+		messages:      make(chan Message), // unbuffered and never drained
+		maxRecvLength: rawSocketMaxBytes(rawSocketMaxLengthDefault),
+		done:          make(chan struct{}),
+	}
+	exited := make(chan struct{})
+	go func() {
+		p.readLoop()
+		close(exited)
+	}()
+
+	// A regular frame with a 1-byte payload; readLoop will block trying to
+	// deliver the deserialized message on the undrained messages channel.
+	if _, err := client.Write([]byte{rawSocketMsgTypeRegular, 0, 0, 1, 'x'}); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	closed := make(chan struct{})
+	go func() {
+		p.Close()
+		close(closed)
+	}()
+
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("Close blocked indefinitely while readLoop was stuck delivering a message")
+	}
+
+	select {
+	case <-exited:
+	case <-time.After(time.Second):
+		t.Fatal("readLoop stayed blocked delivering a message after Close")
+	}
+}
@@ -0,0 +1,91 @@
+package turnpike
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/ekroymann/turnpike/auth"
+	"github.com/gorilla/websocket"
+)
+
+// errPeerClosed is returned by Send once the peer has begun closing.
+var errPeerClosed = errors.New("turnpike: peer is closed")
+
+// websocketPeer is the Peer implementation backing a single websocket
+// connection. All writes to conn go through writePump, which is started
+// alongside readPump in handleWebsocket; Send only ever hands frames to
+// writePump via the outgoing channel so that the two never race on the
+// connection.
+type websocketPeer struct {
+	conn        *websocket.Conn
+	serializer  Serializer
+	messages    chan Message
+	payloadType int
+	authDetails auth.Details
+
+	outgoing  chan outgoingFrame
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// Send serializes msg and queues it for delivery by writePump.
+func (p *websocketPeer) Send(msg Message) error {
+	b, err := p.serializer.Serialize(msg)
+	if err != nil {
+		return err
+	}
+	select {
+	case <-p.done:
+		return errPeerClosed
+	default:
+	}
+	select {
+	case p.outgoing <- outgoingFrame{p.payloadType, b}:
+		return nil
+	case <-p.done:
+		return errPeerClosed
+	}
+}
+
+// Receive returns the channel of messages sent by the peer.
+func (p *websocketPeer) Receive() <-chan Message {
+	return p.messages
+}
+
+// AuthDetails returns the auth.Details gathered by the WebsocketServer's
+// Authenticator before the websocket upgrade, if any. Realms can type-assert
+// an incoming Peer to AuthenticatedPeer during HELLO processing to honor
+// this out-of-band authentication.
+func (p *websocketPeer) AuthDetails() auth.Details {
+	return p.authDetails
+}
+
+// Close begins a graceful shutdown. p.done is closed first so that nothing
+// (including this call) can ever block waiting on a writePump that may
+// already have exited on its own (e.g. a failed ping or a full outgoing
+// queue on a dead connection); the GOODBYE is then queued best-effort for
+// writePump to flush before it sends the websocket close frame. It is safe
+// to call Close multiple times.
+func (p *websocketPeer) Close() error {
+	p.closeOnce.Do(func() {
+		close(p.done)
+		if b, err := p.serializer.Serialize(&Goodbye{Details: map[string]interface{}{}, Reason: URI("wamp.close.goodbye_and_out")}); err == nil {
+			select {
+			case p.outgoing <- outgoingFrame{p.payloadType, b}:
+			default:
+				// writePump has already exited or the queue is full; drop
+				// the GOODBYE rather than block shutdown on it.
+			}
+		}
+	})
+	return nil
+}
+
+// AuthenticatedPeer is implemented by peers that can supply auth.Details
+// gathered before the WAMP session was established (e.g. by a
+// WebsocketServer's pre-upgrade Authenticator). Realms should type-assert
+// incoming peers to this interface while processing HELLO to honor
+// out-of-band authentication.
+type AuthenticatedPeer interface {
+	AuthDetails() auth.Details
+}
@@ -0,0 +1,60 @@
+package turnpike
+
+import (
+	"testing"
+	"time"
+)
+
+type websocketTestSerializer struct{}
+
+func (websocketTestSerializer) Serialize(msg Message) ([]byte, error)  { return []byte("x"), nil }
+func (websocketTestSerializer) Deserialize(b []byte) (Message, error) { return nil, nil }
+
+func newTestWebsocketPeer(outgoingSize int) *websocketPeer {
+	return &websocketPeer{
+		serializer: websocketTestSerializer{},
+		messages:   make(chan Message, 1),
+		outgoing:   make(chan outgoingFrame, outgoingSize),
+		done:       make(chan struct{}),
+	}
+}
+
+// TestWebsocketPeerCloseDoesNotDeadlock guards against Close hanging when
+// writePump has already exited (e.g. after a failed ping) and outgoing is
+// full, which used to happen because Close sent the GOODBYE through Send
+// before closing done.
+func TestWebsocketPeerCloseDoesNotDeadlock(t *testing.T) {
+	p := newTestWebsocketPeer(1)
+	p.outgoing <- outgoingFrame{} // fill the queue as writePump would have left it
+
+	closed := make(chan struct{})
+	go func() {
+		p.Close()
+		close(closed)
+	}()
+
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("Close blocked indefinitely when the outgoing queue was already full")
+	}
+}
+
+func TestWebsocketPeerCloseIsIdempotent(t *testing.T) {
+	p := newTestWebsocketPeer(1)
+	if err := p.Close(); err != nil {
+		t.Fatalf("first Close returned error: %v", err)
+	}
+	if err := p.Close(); err != nil {
+		t.Fatalf("second Close returned error: %v", err)
+	}
+}
+
+func TestWebsocketPeerSendAfterCloseReturnsError(t *testing.T) {
+	p := newTestWebsocketPeer(1)
+	p.Close()
+
+	if err := p.Send(nil); err != errPeerClosed {
+		t.Fatalf("Send after Close returned %v, want errPeerClosed", err)
+	}
+}
@@ -0,0 +1,183 @@
+package turnpike
+
+import (
+	"crypto/tls"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// UpstreamSelector chooses the upstream WAMP router URL (ws:// or wss://) to
+// proxy a given HTTP upgrade request to, along with any extra headers that
+// should be sent to the upstream on dial.
+type UpstreamSelector func(r *http.Request) (upstreamURL string, hdr http.Header, err error)
+
+// WebsocketProxy upgrades incoming websocket connections and forwards WAMP
+// sessions to an upstream router, translating subprotocols and preserving
+// frame payload types along the way. This lets turnpike act as an
+// edge/authenticating gateway in front of another WAMP router.
+type WebsocketProxy struct {
+	upgrader *websocket.Upgrader
+	dialer   *websocket.Dialer
+
+	selectUpstream UpstreamSelector
+
+	// Authorize, if set, is re-run on ReauthorizeInterval for the lifetime
+	// of the proxied connection; a returned error tears down both sides.
+	Authorize           func(r *http.Request) error
+	ReauthorizeInterval time.Duration
+}
+
+type WebsocketProxyOption func(proxy *WebsocketProxy)
+
+// ProxyCheckOriginPolicy sets the origin check used when accepting
+// connections from downstream clients.
+func ProxyCheckOriginPolicy(policy func(r *http.Request) bool) WebsocketProxyOption {
+	return func(proxy *WebsocketProxy) {
+		proxy.upgrader.CheckOrigin = policy
+	}
+}
+
+// ProxyTLSClientConfig sets the TLS configuration used when dialing wss://
+// upstreams.
+func ProxyTLSClientConfig(cfg *tls.Config) WebsocketProxyOption {
+	return func(proxy *WebsocketProxy) {
+		proxy.dialer.TLSClientConfig = cfg
+	}
+}
+
+// ProxyAuthorization installs a callback that is re-checked on the given
+// interval for as long as a proxied connection is open; an error from it
+// closes the connection in both directions.
+func ProxyAuthorization(authorize func(r *http.Request) error, interval time.Duration) WebsocketProxyOption {
+	return func(proxy *WebsocketProxy) {
+		proxy.Authorize = authorize
+		proxy.ReauthorizeInterval = interval
+	}
+}
+
+// NewWebsocketProxy creates a new WebsocketProxy that forwards connections
+// to the upstream chosen by selector.
+func NewWebsocketProxy(selector UpstreamSelector, options ...WebsocketProxyOption) *WebsocketProxy {
+	log.Println("NewWebsocketProxy")
+	p := &WebsocketProxy{
+		upgrader:       &websocket.Upgrader{},
+		dialer:         &websocket.Dialer{},
+		selectUpstream: selector,
+	}
+	for _, o := range options {
+		o(p)
+	}
+	return p
+}
+
+// ServeHTTP handles a new HTTP connection, upgrading it and proxying it to
+// the selected upstream WAMP router.
+func (p *WebsocketProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	log.Println("WebsocketProxy.ServeHTTP", r.Method, r.RequestURI)
+
+	upstreamURL, hdr, err := p.selectUpstream(r)
+	if err != nil {
+		log.Println("Error selecting upstream:", err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	dialer := *p.dialer
+	dialer.Subprotocols = websocket.Subprotocols(r)
+
+	upstreamConn, upstreamResp, err := dialer.Dial(upstreamURL, hdr)
+	if err != nil {
+		log.Println("Error dialing upstream WAMP router:", err)
+		http.Error(w, "Error contacting upstream router", http.StatusBadGateway)
+		return
+	}
+	defer upstreamConn.Close()
+
+	respHeader := http.Header{}
+	if negotiated := upstreamResp.Header.Get("Sec-WebSocket-Protocol"); negotiated != "" {
+		respHeader.Set("Sec-WebSocket-Protocol", negotiated)
+	}
+	downstreamConn, err := p.upgrader.Upgrade(w, r, respHeader)
+	if err != nil {
+		log.Println("Error upgrading downstream connection:", err)
+		return
+	}
+	defer downstreamConn.Close()
+
+	// Each pump closes its own channel, so no channel is closed twice when
+	// both directions end at once; done is closed when either pump ends.
+	done := make(chan struct{})
+	upDone := make(chan struct{})
+	downDone := make(chan struct{})
+	go func() {
+		select {
+		case <-upDone:
+		case <-downDone:
+		}
+		close(done)
+	}()
+	if p.Authorize != nil {
+		go p.watchAuthorization(r, done, downstreamConn, upstreamConn)
+	}
+
+	go pumpFrames(upstreamConn, downstreamConn, upDone)
+	pumpFrames(downstreamConn, upstreamConn, downDone)
+}
+
+// watchAuthorization re-checks Authorize on ReauthorizeInterval and tears
+// down the proxied connection if it ever fails.
+func (p *WebsocketProxy) watchAuthorization(r *http.Request, done chan struct{}, conns ...*websocket.Conn) {
+	interval := p.ReauthorizeInterval
+	if interval <= 0 {
+		interval = time.Minute
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if err := p.Authorize(r); err != nil {
+				log.Println("Re-authorization failed, closing proxied connection:", err)
+				for _, conn := range conns {
+					conn.Close()
+				}
+				return
+			}
+		}
+	}
+}
+
+// pumpFrames copies websocket frames from src to dst, preserving the
+// payload type and passing PING/PONG control frames through unmodified.
+// It closes done (if not already closed) when the source connection ends.
+func pumpFrames(dst, src *websocket.Conn, done chan struct{}) {
+	src.SetPingHandler(func(data string) error {
+		return dst.WriteMessage(websocket.PingMessage, []byte(data))
+	})
+	src.SetPongHandler(func(data string) error {
+		return dst.WriteMessage(websocket.PongMessage, []byte(data))
+	})
+	for {
+		messageType, b, err := src.ReadMessage()
+		if err != nil {
+			select {
+			case <-done:
+			default:
+				close(done)
+			}
+			return
+		}
+		if err := dst.WriteMessage(messageType, b); err != nil {
+			select {
+			case <-done:
+			default:
+				close(done)
+			}
+			return
+		}
+	}
+}
@@ -2,14 +2,24 @@ package turnpike
 
 import (
 	"fmt"
+	"io/ioutil"
 	"net/http"
+	"time"
 
+	"github.com/ekroymann/turnpike/auth"
 	"github.com/gorilla/websocket"
 )
 
+const (
+	defaultQueueSize = 10
+	defaultPongWait  = 60 * time.Second
+	defaultPingPeriod = defaultPongWait * 9 / 10
+)
+
 const (
 	jsonWebsocketProtocol    = "wamp.2.json"
 	msgpackWebsocketProtocol = "wamp.2.msgpack"
+	cborWebsocketProtocol    = "wamp.2.cbor"
 )
 
 type invalidPayload byte
@@ -25,8 +35,28 @@ func (e protocolExists) Error() string {
 }
 
 type protocol struct {
-	payloadType int
-	serializer  Serializer
+	payloadType   int
+	newSerializer func() Serializer
+}
+
+// Authenticator is run before a websocket upgrade completes. A non-nil
+// error rejects the upgrade; the returned auth.Details (if any) are
+// attached to the resulting peer so realm-level authentication can
+// consult them during the WAMP HELLO handshake, and the returned
+// http.Header is passed through to the upgrade response (for cookies,
+// tokens, or custom subprotocol negotiation).
+type Authenticator func(r *http.Request) (auth.Details, http.Header, error)
+
+// AuthorizationError lets an Authenticator control the HTTP status code
+// sent back when it rejects an upgrade. If Code is zero, ServeHTTP falls
+// back to http.StatusUnauthorized.
+type AuthorizationError struct {
+	Code    int
+	Message string
+}
+
+func (e *AuthorizationError) Error() string {
+	return e.Message
 }
 
 // WebsocketServer handles websocket connections.
@@ -40,6 +70,25 @@ type WebsocketServer struct {
 	TextSerializer Serializer
 	// The serializer to use for binary frames. Defaults to JSONSerializer.
 	BinarySerializer Serializer
+
+	// authenticator, if set, is run before every upgrade to authorize the
+	// request and attach auth.Details to the resulting peer.
+	authenticator Authenticator
+
+	// ReadLimit caps the size, in bytes, of an incoming message. Zero means
+	// no limit. Passed straight through to (*websocket.Conn).SetReadLimit.
+	ReadLimit int64
+	// QueueSize sets the size of each peer's inbound message channel.
+	// Defaults to 10.
+	QueueSize int
+	// PongWait is how long the server waits for a pong (or any other
+	// client activity) before considering the connection dead. Defaults
+	// to 60s.
+	PongWait time.Duration
+	// PingPeriod is how often the server pings an idle connection. Must be
+	// less than PongWait. Defaults to 54s, 9/10 of the default PongWait; it
+	// is not recomputed when PongWait is changed.
+	PingPeriod time.Duration
 }
 
 type WebsocketServerOption func (server *WebsocketServer)
@@ -50,6 +99,53 @@ func CheckOriginPolicy(policy func(r *http.Request) bool) WebsocketServerOption
 	}
 }
 
+// SetAuthenticationHandler installs a pre-upgrade hook that authorizes the
+// HTTP request before it is upgraded to a websocket connection.
+func SetAuthenticationHandler(authenticator Authenticator) WebsocketServerOption {
+	return func(server *WebsocketServer) {
+		server.authenticator = authenticator
+	}
+}
+
+// SetReadLimit caps the size, in bytes, of an incoming message.
+func SetReadLimit(limit int64) WebsocketServerOption {
+	return func(server *WebsocketServer) {
+		server.ReadLimit = limit
+	}
+}
+
+// SetBufferSizes sets the upgrader's read and write buffer sizes.
+func SetBufferSizes(read, write int) WebsocketServerOption {
+	return func(server *WebsocketServer) {
+		server.upgrader.ReadBufferSize = read
+		server.upgrader.WriteBufferSize = write
+	}
+}
+
+// SetHandshakeTimeout bounds how long the initial websocket handshake may take.
+func SetHandshakeTimeout(timeout time.Duration) WebsocketServerOption {
+	return func(server *WebsocketServer) {
+		server.upgrader.HandshakeTimeout = timeout
+	}
+}
+
+// SetKeepalive configures how often an idle peer is pinged (pingPeriod) and
+// how long the server waits for activity before closing the connection
+// (pongWait). pingPeriod should be comfortably less than pongWait.
+func SetKeepalive(pingPeriod, pongWait time.Duration) WebsocketServerOption {
+	return func(server *WebsocketServer) {
+		server.PingPeriod = pingPeriod
+		server.PongWait = pongWait
+	}
+}
+
+// SetQueueSize sets the size of each peer's inbound message channel.
+func SetQueueSize(size int) WebsocketServerOption {
+	return func(server *WebsocketServer) {
+		server.QueueSize = size
+	}
+}
+
 // Creates a new WebsocketServer from a map of realms
 func NewWebsocketServer(realms map[string]Realm, options ...WebsocketServerOption) (*WebsocketServer, error) {
 	log.Println("NewWebsocketServer")
@@ -72,12 +168,16 @@ func NewBasicWebsocketServer(uri string, options ...WebsocketServerOption) *Webs
 
 func newWebsocketServer(r Router, options ...WebsocketServerOption) *WebsocketServer {
 	s := &WebsocketServer{
-		Router:    r,
-		protocols: make(map[string]protocol),
+		Router:     r,
+		protocols:  make(map[string]protocol),
+		QueueSize:  defaultQueueSize,
+		PongWait:   defaultPongWait,
+		PingPeriod: defaultPingPeriod,
 	}
 	s.upgrader = &websocket.Upgrader{}
 	s.RegisterProtocol(jsonWebsocketProtocol, websocket.TextMessage, new(JSONSerializer))
-	s.RegisterProtocol(msgpackWebsocketProtocol, websocket.BinaryMessage, new(MessagePackSerializer))
+	s.RegisterProtocolFactory(msgpackWebsocketProtocol, websocket.BinaryMessage, func() Serializer { return new(MessagePackSerializer) })
+	s.RegisterProtocolFactory(cborWebsocketProtocol, websocket.BinaryMessage, func() Serializer { return new(CBORSerializer) })
 	for _, o := range options {
 		o(s)
 	}
@@ -85,7 +185,16 @@ func newWebsocketServer(r Router, options ...WebsocketServerOption) *WebsocketSe
 }
 
 // RegisterProtocol registers a serializer that should be used for a given protocol string and payload type.
+// The same serializer instance is shared across all peers using this protocol; use RegisterProtocolFactory
+// instead if the serializer carries per-connection state.
 func (s *WebsocketServer) RegisterProtocol(proto string, payloadType int, serializer Serializer) error {
+	return s.RegisterProtocolFactory(proto, payloadType, func() Serializer { return serializer })
+}
+
+// RegisterProtocolFactory registers a serializer factory that should be used for a given protocol string and
+// payload type. The factory is invoked once per connection, so serializers that keep per-connection state
+// (e.g. CBOR shared string tables, msgpack extension registries) aren't leaked across peers.
+func (s *WebsocketServer) RegisterProtocolFactory(proto string, payloadType int, factory func() Serializer) error {
 	log.Println("RegisterProtocol:", proto)
 	if payloadType != websocket.TextMessage && payloadType != websocket.BinaryMessage {
 		return invalidPayload(payloadType)
@@ -93,7 +202,7 @@ func (s *WebsocketServer) RegisterProtocol(proto string, payloadType int, serial
 	if _, ok := s.protocols[proto]; ok {
 		return protocolExists(proto)
 	}
-	s.protocols[proto] = protocol{payloadType, serializer}
+	s.protocols[proto] = protocol{payloadType, factory}
 	s.upgrader.Subprotocols = append(s.upgrader.Subprotocols, proto)
 	return nil
 }
@@ -112,21 +221,39 @@ func (s *WebsocketServer) GetLocalClient(realm string) (*Client, error) {
 // ServeHTTP handles a new HTTP connection.
 func (s *WebsocketServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	log.Println("WebsocketServer.ServeHTTP", r.Method, r.RequestURI)
+
+	var details auth.Details
+	var respHeader http.Header
+	if s.authenticator != nil {
+		d, hdr, err := s.authenticator(r)
+		if err != nil {
+			log.Println("Error authenticating websocket connection:", err)
+			status := http.StatusUnauthorized
+			if ae, ok := err.(*AuthorizationError); ok && ae.Code != 0 {
+				status = ae.Code
+			}
+			http.Error(w, err.Error(), status)
+			return
+		}
+		details = d
+		respHeader = hdr
+	}
+
 	// TODO: subprotocol?
-	conn, err := s.upgrader.Upgrade(w, r, nil)
+	conn, err := s.upgrader.Upgrade(w, r, respHeader)
 	if err != nil {
 		log.Println("Error upgrading to websocket connection:", err)
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	s.handleWebsocket(conn)
+	s.handleWebsocket(conn, details)
 }
 
-func (s *WebsocketServer) handleWebsocket(conn *websocket.Conn) {
+func (s *WebsocketServer) handleWebsocket(conn *websocket.Conn, details auth.Details) {
 	var serializer Serializer
 	var payloadType int
 	if proto, ok := s.protocols[conn.Subprotocol()]; ok {
-		serializer = proto.serializer
+		serializer = proto.newSerializer()
 		payloadType = proto.payloadType
 	} else {
 		// TODO: this will not currently ever be hit because
@@ -145,28 +272,107 @@ func (s *WebsocketServer) handleWebsocket(conn *websocket.Conn) {
 		}
 	}
 
+	if s.ReadLimit > 0 {
+		conn.SetReadLimit(s.ReadLimit)
+	}
+	conn.SetReadDeadline(time.Now().Add(s.PongWait))
+	conn.SetPongHandler(func(string) error {
+		conn.SetReadDeadline(time.Now().Add(s.PongWait))
+		return nil
+	})
+
 	peer := websocketPeer{
 		conn:        conn,
 		serializer:  serializer,
-		messages:    make(chan Message, 10),
+		messages:    make(chan Message, s.QueueSize),
 		payloadType: payloadType,
+		authDetails: details,
+		outgoing:    make(chan outgoingFrame, s.QueueSize),
+		done:        make(chan struct{}),
 	}
-	go func() {
-		for {
-			// TODO: use conn.NextMessage() and stream
-			// TODO: do something different based on binary/text frames
-			if _, b, err := conn.ReadMessage(); err != nil {
-				conn.Close()
-				break
-			} else {
-				msg, err := serializer.Deserialize(b)
-				if err != nil {
-					// TODO: handle error
-				} else {
-					peer.messages <- msg
+	go peer.writePump(s.PingPeriod)
+	go peer.readPump()
+	s.Router.Accept(&peer)
+}
+
+// outgoingFrame is a single frame queued for the peer's writer goroutine,
+// which is the sole owner of conn.WriteMessage; gorilla/websocket requires
+// that all writes to a connection be serialized.
+type outgoingFrame struct {
+	payloadType int
+	data        []byte
+}
+
+// readPump streams frames off the connection and deserializes them,
+// handing completed messages to the router via p.messages. It never
+// writes to the connection directly.
+func (p *websocketPeer) readPump() {
+	defer p.Close()
+	for {
+		messageType, r, err := p.conn.NextReader()
+		if err != nil {
+			return
+		}
+		b, err := ioutil.ReadAll(r)
+		if err != nil {
+			return
+		}
+		if messageType != p.payloadType {
+			// a frame arrived using a payload type other than the one
+			// negotiated for this peer's serializer; drop it rather than
+			// feeding garbage to the serializer.
+			continue
+		}
+		msg, err := p.serializer.Deserialize(b)
+		if err != nil {
+			// TODO: handle error
+			continue
+		}
+		select {
+		case p.messages <- msg:
+		case <-p.done:
+			return
+		}
+	}
+}
+
+// writePump is the sole writer of the connection: it relays queued
+// outgoing frames, sends periodic pings, and performs a graceful
+// WAMP GOODBYE + websocket close handshake when the peer is closed.
+func (p *websocketPeer) writePump(pingPeriod time.Duration) {
+	ticker := time.NewTicker(pingPeriod)
+	defer ticker.Stop()
+	defer p.conn.Close()
+	for {
+		select {
+		case frame, ok := <-p.outgoing:
+			if !ok {
+				return
+			}
+			if err := p.conn.WriteMessage(frame.payloadType, frame.data); err != nil {
+				return
+			}
+		case <-ticker.C:
+			if err := p.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		case <-p.done:
+			// Flush any frame already queued (notably the GOODBYE queued
+			// by Close) before the websocket close frame, so the session
+			// ends with a proper WAMP GOODBYE rather than just dropping
+			// the connection.
+		drain:
+			for {
+				select {
+				case frame := <-p.outgoing:
+					p.conn.WriteMessage(frame.payloadType, frame.data)
+				default:
+					break drain
 				}
 			}
+			p.conn.WriteMessage(websocket.CloseMessage,
+				websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+			return
 		}
-	}()
-	s.Router.Accept(&peer)
+	}
 }